@@ -10,25 +10,35 @@ import (
 
 // OMIConfig is for common configuration related to creating OMIs.
 type OMIConfig struct {
-	OMIName                 string            `mapstructure:"omi_name"`
-	OMIDescription          string            `mapstructure:"omi_description"`
-	OMIVirtType             string            `mapstructure:"omi_virtualization_type"`
-	OMIUsers                []string          `mapstructure:"omi_users"`
-	OMIGroups               []string          `mapstructure:"omi_groups"`
-	OMIProductCodes         []string          `mapstructure:"omi_product_codes"`
-	OMIRegions              []string          `mapstructure:"omi_regions"`
-	OMISkipRegionValidation bool              `mapstructure:"skip_region_validation"`
-	OMITags                 TagMap            `mapstructure:"tags"`
-	OMIENASupport           *bool             `mapstructure:"ena_support"`
-	OMISriovNetSupport      bool              `mapstructure:"sriov_support"`
-	OMIForceDeregister      bool              `mapstructure:"force_deregister"`
-	OMIForceDeleteSnapshot  bool              `mapstructure:"force_delete_snapshot"`
-	OMIEncryptBootVolume    bool              `mapstructure:"encrypt_boot"`
-	OMIKmsKeyId             string            `mapstructure:"kms_key_id"`
-	OMIRegionKMSKeyIDs      map[string]string `mapstructure:"region_kms_key_ids"`
-	SnapshotTags            TagMap            `mapstructure:"snapshot_tags"`
-	SnapshotUsers           []string          `mapstructure:"snapshot_users"`
-	SnapshotGroups          []string          `mapstructure:"snapshot_groups"`
+	OMIName                 string                    `mapstructure:"omi_name"`
+	OMIDescription          string                    `mapstructure:"omi_description"`
+	OMIVirtType             string                    `mapstructure:"omi_virtualization_type"`
+	OMIUsers                []string                  `mapstructure:"omi_users"`
+	OMIGroups               []string                  `mapstructure:"omi_groups"`
+	OMIProductCodes         []string                  `mapstructure:"omi_product_codes"`
+	OMIRegions              []string                  `mapstructure:"omi_regions"`
+	OMISkipRegionValidation bool                      `mapstructure:"skip_region_validation"`
+	OMITags                 TagMap                    `mapstructure:"tags"`
+	OMIENASupport           *bool                     `mapstructure:"ena_support"`
+	OMISriovNetSupport      bool                      `mapstructure:"sriov_support"`
+	OMIForceDeregister      bool                      `mapstructure:"force_deregister"`
+	OMIForceDeleteSnapshot  bool                      `mapstructure:"force_delete_snapshot"`
+	OMIEncryptBootVolume    bool                      `mapstructure:"encrypt_boot"`
+	OMIKmsKeyId             string                    `mapstructure:"kms_key_id"`
+	OMIRegionKMSKeyIDs      map[string]string         `mapstructure:"region_kms_key_ids"`
+	OMIRegionUsers          map[string]OMIRegionShare `mapstructure:"omi_region_users"`
+	SnapshotTags            TagMap                    `mapstructure:"snapshot_tags"`
+	SnapshotUsers           []string                  `mapstructure:"snapshot_users"`
+	SnapshotGroups          []string                  `mapstructure:"snapshot_groups"`
+	SnapshotRegionUsers     map[string]OMIRegionShare `mapstructure:"snapshot_region_users"`
+}
+
+// OMIRegionShare lists the account IDs that a region-specific copy of the
+// OMI (or its backing snapshot) should be shared with. It lets users give
+// different regions different distribution audiences instead of sharing
+// the same flat list everywhere.
+type OMIRegionShare struct {
+	AccountIds []string `mapstructure:"account_ids"`
 }
 
 func stringInSlice(s []string, searchstr string) bool {
@@ -57,6 +67,11 @@ func (c *OMIConfig) Prepare(accessConfig *AccessConfig, ctx *interpolate.Context
 		}
 	}
 
+	// Keep the regions the user configured before prepareRegions strips
+	// out the source region, so region_users validation below checks
+	// against what the user actually typed.
+	originalRegions := append([]string(nil), c.OMIRegions...)
+
 	errs = append(errs, c.prepareRegions(accessConfig)...)
 
 	if len(c.OMIUsers) > 0 && c.OMIEncryptBootVolume {
@@ -93,6 +108,8 @@ func (c *OMIConfig) Prepare(accessConfig *AccessConfig, ctx *interpolate.Context
 		}
 	}
 
+	errs = append(errs, c.prepareRegionUsers(originalRegions, accessConfig)...)
+
 	if len(c.OMIName) < 3 || len(c.OMIName) > 128 {
 		errs = append(errs, fmt.Errorf("omi_name must be between 3 and 128 characters long"))
 	}
@@ -147,6 +164,66 @@ func (c *OMIConfig) prepareRegions(accessConfig *AccessConfig) (errs []error) {
 	return errs
 }
 
+// prepareRegionUsers validates the per-region sharing maps: it rejects
+// mixing the flat and per-region forms, makes sure every region key also
+// appears in regions (the omi_regions the user configured, before
+// prepareRegions strips out the source region), rejects the source
+// region as a key since it is never copied and so never has per-region
+// sharing applied to it. It rejects per-region OMI sharing whenever
+// encrypt_boot is set, and rejects per-region snapshot sharing of an
+// encrypted snapshot when the region has neither a region_kms_key_ids
+// entry nor a kms_key_id fallback.
+func (c *OMIConfig) prepareRegionUsers(regions []string, accessConfig *AccessConfig) (errs []error) {
+	if len(c.OMIUsers) > 0 && len(c.OMIRegionUsers) > 0 {
+		errs = append(errs, fmt.Errorf("Cannot use both omi_users and omi_region_users, use one or the other"))
+	}
+	if len(c.SnapshotUsers) > 0 && len(c.SnapshotRegionUsers) > 0 {
+		errs = append(errs, fmt.Errorf("Cannot use both snapshot_users and snapshot_region_users, use one or the other"))
+	}
+
+	for region, share := range c.OMIRegionUsers {
+		if !stringInSlice(regions, region) {
+			errs = append(errs, fmt.Errorf("Region %s is in omi_region_users but not in omi_regions", region))
+			continue
+		}
+
+		if accessConfig != nil && region == accessConfig.RawRegion {
+			errs = append(errs, fmt.Errorf("Region %s in omi_region_users is the source region; it is never copied, so no per-region sharing can be applied to it", region))
+			continue
+		}
+
+		if len(share.AccountIds) > 0 && c.OMIEncryptBootVolume {
+			errs = append(errs, fmt.Errorf("Cannot share OMI with encrypted boot volume in region %s", region))
+		}
+	}
+
+	for region, share := range c.SnapshotRegionUsers {
+		if !stringInSlice(regions, region) {
+			errs = append(errs, fmt.Errorf("Region %s is in snapshot_region_users but not in omi_regions", region))
+			continue
+		}
+
+		if accessConfig != nil && region == accessConfig.RawRegion {
+			errs = append(errs, fmt.Errorf("Region %s in snapshot_region_users is the source region; it is never copied, so no per-region sharing can be applied to it", region))
+			continue
+		}
+
+		if len(share.AccountIds) == 0 {
+			continue
+		}
+
+		if !c.OMIEncryptBootVolume {
+			continue
+		}
+
+		if len(regionKmsKeyId(c.OMIRegionKMSKeyIDs, c.OMIKmsKeyId, region)) == 0 {
+			errs = append(errs, fmt.Errorf("Cannot share snapshot encrypted with default KMS key in region %s", region))
+		}
+	}
+
+	return errs
+}
+
 func validateKmsKey(kmsKey string) (valid bool) {
 	kmsKeyIdPattern := `[a-f0-9-]+$`
 	aliasPattern := `alias/[a-zA-Z0-9:/_-]+$`
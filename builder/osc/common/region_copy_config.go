@@ -0,0 +1,38 @@
+package common
+
+import "fmt"
+
+// RegionCopyConfig configures the encrypted copy pipeline that copies
+// the built OMI into each of omi_regions and re-encrypts it there with
+// a region-specific (or fallback) KMS key.
+type RegionCopyConfig struct {
+	SkipSaveSourceOMI bool `mapstructure:"skip_save_source_omi"`
+}
+
+// Prepare makes sure that, when the source OMI is encrypted, every
+// destination region has a KMS key to re-encrypt its copy with: either
+// its own region_kms_key_ids entry or the shared kms_key_id fallback.
+func (c *RegionCopyConfig) Prepare(omiConfig *OMIConfig) (errs []error) {
+	if !omiConfig.OMIEncryptBootVolume {
+		return nil
+	}
+
+	for _, region := range omiConfig.OMIRegions {
+		if len(regionKmsKeyId(omiConfig.OMIRegionKMSKeyIDs, omiConfig.OMIKmsKeyId, region)) == 0 {
+			errs = append(errs, fmt.Errorf(
+				"Region %s has no region_kms_key_ids entry and no kms_key_id fallback to encrypt its OMI copy with", region))
+		}
+	}
+
+	return errs
+}
+
+// regionKmsKeyId returns the KMS key to use when copying the OMI into
+// region: the region's own entry in regionKMSKeyIDs if set, falling
+// back to fallbackKmsKeyId.
+func regionKmsKeyId(regionKMSKeyIDs map[string]string, fallbackKmsKeyId, region string) string {
+	if kmsKeyId, ok := regionKMSKeyIDs[region]; ok && len(kmsKeyId) > 0 {
+		return kmsKeyId
+	}
+	return fallbackKmsKeyId
+}
@@ -0,0 +1,202 @@
+package common
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/hashicorp/packer/helper/multistep"
+	"github.com/hashicorp/packer/packer"
+)
+
+// maxConcurrentRegionCopies bounds how many destination regions are
+// copied to at once, so a long omi_regions list doesn't open an
+// unbounded number of connections to the Outscale API.
+const maxConcurrentRegionCopies = 5
+
+// StepRegionCopyOMI copies the OMI built in the builder's source region
+// into each of the configured destination regions, re-encrypting it
+// there with the region's KMS key when the source OMI is encrypted,
+// then applies the per-region tags and sharing rules to the resulting
+// OMI and snapshot.
+type StepRegionCopyOMI struct {
+	AccessConfig        *AccessConfig
+	RegionCopyConfig    *RegionCopyConfig
+	Regions             []string
+	Encrypted           bool
+	OMIKmsKeyId         string
+	OMIRegionKMSKeyIDs  map[string]string
+	OMITags             TagMap
+	OMIUsers            []string
+	OMIGroups           []string
+	OMIRegionUsers      map[string]OMIRegionShare
+	SnapshotTags        TagMap
+	SnapshotUsers       []string
+	SnapshotRegionUsers map[string]OMIRegionShare
+}
+
+func (s *StepRegionCopyOMI) Run(state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packer.Ui)
+
+	if len(s.Regions) == 0 {
+		return multistep.ActionContinue
+	}
+
+	omis := state.Get("omis").(map[string]string)
+	sourceRegion := state.Get("source_region").(string)
+	sourceOMI := omis[sourceRegion]
+
+	ui.Say("Copying OMI to other regions...")
+
+	sem := make(chan struct{}, maxConcurrentRegionCopies)
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	errs := new(packer.MultiError)
+
+	for _, region := range s.Regions {
+		wg.Add(1)
+		go func(region string) {
+			defer wg.Done()
+
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			omiId, err := s.copyRegion(sourceRegion, region, sourceOMI)
+			if err != nil {
+				lock.Lock()
+				errs = packer.MultiErrorAppend(errs, fmt.Errorf("error copying OMI to region %s: %s", region, err))
+				lock.Unlock()
+				return
+			}
+
+			if err := s.shareRegion(region, omiId); err != nil {
+				lock.Lock()
+				errs = packer.MultiErrorAppend(errs, fmt.Errorf("error sharing OMI in region %s: %s", region, err))
+				lock.Unlock()
+				return
+			}
+
+			lock.Lock()
+			omis[region] = omiId
+			lock.Unlock()
+		}(region)
+	}
+
+	wg.Wait()
+
+	if len(errs.Errors) > 0 {
+		state.Put("error", errs)
+		ui.Error(errs.Error())
+		return multistep.ActionHalt
+	}
+
+	state.Put("omis", omis)
+
+	if s.RegionCopyConfig != nil && s.RegionCopyConfig.SkipSaveSourceOMI {
+		if err := s.deregisterSourceOMI(sourceRegion, sourceOMI); err != nil {
+			err = fmt.Errorf("error deregistering source OMI %s: %s", sourceOMI, err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+		delete(omis, sourceRegion)
+		state.Put("omis", omis)
+	}
+
+	return multistep.ActionContinue
+}
+
+// copyRegion copies sourceOMI from sourceRegion into region, waits for
+// the copy to finish, re-encrypting it with the region's KMS key when
+// the step is configured for an encrypted copy, and tags the result.
+func (s *StepRegionCopyOMI) copyRegion(sourceRegion, region, sourceOMI string) (string, error) {
+	conn, err := s.AccessConfig.NewOSCClientByRegion(region)
+	if err != nil {
+		return "", err
+	}
+
+	kmsKeyId := ""
+	if s.Encrypted {
+		kmsKeyId = regionKmsKeyId(s.OMIRegionKMSKeyIDs, s.OMIKmsKeyId, region)
+	}
+
+	omiId, err := conn.CopyImage(sourceRegion, sourceOMI, s.Encrypted, kmsKeyId)
+	if err != nil {
+		return "", err
+	}
+
+	if err := conn.WaitForImageAvailable(omiId); err != nil {
+		return "", err
+	}
+
+	if len(s.OMITags) > 0 {
+		if err := conn.CreateTags(omiId, s.OMITags); err != nil {
+			return "", err
+		}
+	}
+
+	if len(s.SnapshotTags) > 0 {
+		snapshotId, err := conn.SnapshotIdForImage(omiId)
+		if err != nil {
+			return "", err
+		}
+		if err := conn.CreateTags(snapshotId, s.SnapshotTags); err != nil {
+			return "", err
+		}
+	}
+
+	return omiId, nil
+}
+
+// shareRegion applies the launchPermission/createVolumePermission
+// additions for region to omiId and its backing snapshot.
+func (s *StepRegionCopyOMI) shareRegion(region, omiId string) error {
+	omiUsers := s.OMIUsers
+	if share, ok := s.OMIRegionUsers[region]; ok {
+		omiUsers = share.AccountIds
+	}
+
+	snapshotUsers := s.SnapshotUsers
+	if share, ok := s.SnapshotRegionUsers[region]; ok {
+		snapshotUsers = share.AccountIds
+	}
+
+	if len(omiUsers) == 0 && len(s.OMIGroups) == 0 && len(snapshotUsers) == 0 {
+		return nil
+	}
+
+	conn, err := s.AccessConfig.NewOSCClientByRegion(region)
+	if err != nil {
+		return err
+	}
+
+	if len(omiUsers) > 0 || len(s.OMIGroups) > 0 {
+		if err := conn.ModifyImageAttribute(omiId, omiUsers, s.OMIGroups); err != nil {
+			return err
+		}
+	}
+
+	if len(snapshotUsers) > 0 {
+		snapshotId, err := conn.SnapshotIdForImage(omiId)
+		if err != nil {
+			return err
+		}
+		if err := conn.ModifySnapshotAttribute(snapshotId, snapshotUsers); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deregisterSourceOMI removes the initial unencrypted OMI once every
+// encrypted regional copy has succeeded.
+func (s *StepRegionCopyOMI) deregisterSourceOMI(sourceRegion, sourceOMI string) error {
+	conn, err := s.AccessConfig.NewOSCClientByRegion(sourceRegion)
+	if err != nil {
+		return err
+	}
+
+	return conn.DeregisterImage(sourceOMI)
+}
+
+func (s *StepRegionCopyOMI) Cleanup(multistep.StateBag) {}